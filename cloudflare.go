@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const cloudflareAPIBase = "https://api.cloudflare.com/client/v4"
+
+// cfLimiter throttles outgoing Cloudflare API calls to stay under its
+// 1200-requests-per-5-minutes global limit; sized from --cloudflare-rps by
+// initCloudflareRateLimiter.
+var cfLimiter = rate.NewLimiter(rate.Limit(4), 4)
+
+func initCloudflareRateLimiter(rps float64) {
+	if rps <= 0 {
+		rps = 4
+	}
+	burst := int(rps)
+	if burst < 1 {
+		burst = 1
+	}
+	cfLimiter = rate.NewLimiter(rate.Limit(rps), burst)
+}
+
+// cfHTTPError is returned by doCFRequest for retryable Cloudflare responses
+// (429 or 5xx), carrying any Retry-After the API gave us.
+type cfHTTPError struct {
+	StatusCode int
+	RetryAfter time.Duration
+	err        error
+}
+
+func (e *cfHTTPError) Error() string { return e.err.Error() }
+func (e *cfHTTPError) Unwrap() error { return e.err }
+
+func parseRetryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(header); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(header); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+func retryBackoff(attempt int) time.Duration {
+	d := time.Duration(1<<uint(attempt)) * time.Second
+	if d > 30*time.Second {
+		d = 30 * time.Second
+	}
+	return d
+}
+
+type cfError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type cfResponse struct {
+	Success bool            `json:"success"`
+	Errors  []cfError       `json:"errors"`
+	Result  json.RawMessage `json:"result"`
+}
+
+type cfZone struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type cfRecord struct {
+	ID      string `json:"id,omitempty"`
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Content string `json:"content"`
+	TTL     int    `json:"ttl"`
+	Proxied bool   `json:"proxied"`
+}
+
+// cfRequest performs an authenticated, rate-limited Cloudflare API call and
+// decodes the result into v, if v is non-nil. It retries on 429/5xx with
+// exponential backoff, honoring any Retry-After the API sends. op identifies
+// the call for the cfsync_cloudflare_api_requests_total/
+// cfsync_cloudflare_api_duration_seconds metrics (e.g. "list_records",
+// "create_record").
+func cfRequest(ctx context.Context, op, method, path string, body interface{}, v interface{}) error {
+	const maxAttempts = 5
+
+	var err error
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		if waitErr := cfLimiter.Wait(ctx); waitErr != nil {
+			return waitErr
+		}
+
+		start := time.Now()
+		err = doCFRequest(ctx, method, path, body, v)
+		cloudflareAPIDuration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+
+		var httpErr *cfHTTPError
+		if errors.As(err, &httpErr) {
+			cloudflareAPIRequests.WithLabelValues(op, "retry").Inc()
+			wait := httpErr.RetryAfter
+			if wait <= 0 {
+				wait = retryBackoff(attempt)
+			}
+			select {
+			case <-time.After(wait):
+				continue
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		status := "success"
+		if err != nil {
+			status = "error"
+		}
+		cloudflareAPIRequests.WithLabelValues(op, status).Inc()
+		return err
+	}
+
+	cloudflareAPIRequests.WithLabelValues(op, "error").Inc()
+	return fmt.Errorf("cloudflare api: exceeded retries for %s: %w", op, err)
+}
+
+func doCFRequest(ctx context.Context, method, path string, body interface{}, v interface{}) error {
+	var reqBody []byte
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = b
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, cloudflareAPIBase+path, bytes.NewReader(reqBody))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	if options.CloudflareAPIToken != "" {
+		req.Header.Set("Authorization", "Bearer "+options.CloudflareAPIToken)
+	} else {
+		req.Header.Set("X-Auth-Email", options.CloudflareAPIEmail)
+		req.Header.Set("X-Auth-Key", options.CloudflareAPIKey)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		return &cfHTTPError{
+			StatusCode: resp.StatusCode,
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+			err:        fmt.Errorf("cloudflare api returned %d", resp.StatusCode),
+		}
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	var cfResp cfResponse
+	if err := json.Unmarshal(data, &cfResp); err != nil {
+		return fmt.Errorf("decoding cloudflare response: %w", err)
+	}
+	if !cfResp.Success {
+		return fmt.Errorf("cloudflare api error: %v", cfResp.Errors)
+	}
+
+	if v != nil && len(cfResp.Result) > 0 {
+		if err := json.Unmarshal(cfResp.Result, v); err != nil {
+			return fmt.Errorf("decoding cloudflare result: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// findRoot returns the DNS root in roots that fqdn belongs to.
+func findRoot(fqdn string, roots []string) (string, error) {
+	for _, root := range roots {
+		if fqdn == root || strings.HasSuffix(fqdn, "."+root) {
+			return root, nil
+		}
+	}
+	return "", fmt.Errorf("%s is not within any of the configured dns roots", fqdn)
+}
+
+var (
+	zoneIDCacheMu sync.Mutex
+	zoneIDCache   = map[string]string{}
+)
+
+// zoneIDForRoot looks up the Cloudflare zone ID for a root domain, caching
+// the result for the life of the process since a root's zone ID never
+// changes.
+func zoneIDForRoot(ctx context.Context, root string) (string, error) {
+	zoneIDCacheMu.Lock()
+	id, ok := zoneIDCache[root]
+	zoneIDCacheMu.Unlock()
+	if ok {
+		return id, nil
+	}
+
+	var zones []cfZone
+	if err := cfRequest(ctx, "list_zones", http.MethodGet, "/zones?name="+root, nil, &zones); err != nil {
+		return "", err
+	}
+	if len(zones) == 0 {
+		return "", fmt.Errorf("no cloudflare zone found for %s", root)
+	}
+
+	zoneIDCacheMu.Lock()
+	zoneIDCache[root] = zones[0].ID
+	zoneIDCacheMu.Unlock()
+	return zones[0].ID, nil
+}
+
+// recordBatch caches every DNS record of a zone for the lifetime of a single
+// reconciliation pass, so visiting many endpoints in the same zone costs one
+// list call instead of one per endpoint. It's invalidated for a zone as soon
+// as that zone is mutated, so later lookups in the same pass stay accurate.
+type recordBatch struct {
+	zones map[string][]cfRecord
+}
+
+func newRecordBatch() *recordBatch {
+	return &recordBatch{zones: map[string][]cfRecord{}}
+}
+
+func (b *recordBatch) load(ctx context.Context, zoneID string) ([]cfRecord, error) {
+	if records, ok := b.zones[zoneID]; ok {
+		return records, nil
+	}
+
+	var records []cfRecord
+	path := fmt.Sprintf("/zones/%s/dns_records", zoneID)
+	if err := cfRequest(ctx, "list_records", http.MethodGet, path, nil, &records); err != nil {
+		return nil, err
+	}
+
+	b.zones[zoneID] = records
+	return records, nil
+}
+
+func (b *recordBatch) filter(ctx context.Context, zoneID string, match func(cfRecord) bool) ([]cfRecord, error) {
+	records, err := b.load(ctx, zoneID)
+	if err != nil {
+		return nil, err
+	}
+
+	var matched []cfRecord
+	for _, r := range records {
+		if match(r) {
+			matched = append(matched, r)
+		}
+	}
+	return matched, nil
+}
+
+func (b *recordBatch) invalidate(zoneID string) {
+	delete(b.zones, zoneID)
+}
+
+// upsertRecord creates rec unless a record with the same type, name and
+// content already exists; such a record is updated in-place if its ttl or
+// proxied status differ. Records of the same type and name with other
+// content are left for deleteStaleRecords.
+func upsertRecord(ctx context.Context, b *recordBatch, zoneID string, rec cfRecord) error {
+	existing, err := b.filter(ctx, zoneID, func(r cfRecord) bool {
+		return r.Type == rec.Type && r.Name == rec.Name
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, e := range existing {
+		if e.Content == rec.Content {
+			if e.TTL == rec.TTL && e.Proxied == rec.Proxied {
+				return nil
+			}
+			path := fmt.Sprintf("/zones/%s/dns_records/%s", zoneID, e.ID)
+			if err := cfRequest(ctx, "update_record", http.MethodPut, path, rec, nil); err != nil {
+				return err
+			}
+			b.invalidate(zoneID)
+			return nil
+		}
+	}
+
+	path := fmt.Sprintf("/zones/%s/dns_records", zoneID)
+	if err := cfRequest(ctx, "create_record", http.MethodPost, path, rec, nil); err != nil {
+		return err
+	}
+	b.invalidate(zoneID)
+	return nil
+}
+
+// deleteStaleRecords removes any existing records of recordType for name
+// whose content is not present in keep.
+func deleteStaleRecords(ctx context.Context, b *recordBatch, zoneID, recordType, name string, keep []string) error {
+	existing, err := b.filter(ctx, zoneID, func(r cfRecord) bool {
+		return r.Type == recordType && r.Name == name
+	})
+	if err != nil {
+		return err
+	}
+
+	keepSet := make(map[string]bool, len(keep))
+	for _, k := range keep {
+		keepSet[k] = true
+	}
+
+	for _, e := range existing {
+		if !keepSet[e.Content] {
+			path := fmt.Sprintf("/zones/%s/dns_records/%s", zoneID, e.ID)
+			if err := cfRequest(ctx, "delete_record", http.MethodDelete, path, nil, nil); err != nil {
+				return err
+			}
+			b.invalidate(zoneID)
+		}
+	}
+	return nil
+}
+
+// reconcile syncs the given endpoints against Cloudflare so that each
+// endpoint's DNSName resolves (via an A, AAAA or CNAME record, per
+// endpoint.Type) to its Targets. dnsRoots maps every endpoint to its zone.
+// dnsNames/ttl are the node-source --dns-name configuration, used only to
+// drive the tunnel ingress reconciliation: when cloudflare tunnel options
+// are configured, it
+// additionally reconciles the tunnel ingress configuration and a CNAME
+// pointing each dnsName at the tunnel instead of the raw ips.
+//
+// Every managed record is paired with a TXT heritage record identifying it
+// as ours (see registry.go). Records in the zone without that marker are
+// left untouched, even if their name matches one of our endpoints, and a
+// name already carrying another controller's heritage TXT (a different
+// --txt-owner-id) is skipped entirely rather than taken over.
+func reconcile(ctx context.Context, endpoints []endpoint, dnsNames []string, dnsRoots []string, ttl int) error {
+	batch := newRecordBatch()
+	ownership := map[string]zoneOwnership{} // zoneID -> ownership
+
+	if options.CloudflareTunnelID != "" {
+		if err := syncTunnel(ctx, batch, ownership, dnsNames, dnsRoots, ttl); err != nil {
+			return err
+		}
+	}
+
+	for _, ep := range endpoints {
+		if options.tunnelServiceFor(ep.DNSName) != "" {
+			// this hostname is served through the tunnel; its CNAME is
+			// managed by syncTunnel above.
+			continue
+		}
+
+		root, err := findRoot(ep.DNSName, dnsRoots)
+		if err != nil {
+			return err
+		}
+
+		zoneID, err := zoneIDForRoot(ctx, root)
+		if err != nil {
+			return err
+		}
+
+		zoneOwned, err := zoneOwnershipFor(ctx, batch, ownership, zoneID)
+		if err != nil {
+			return err
+		}
+
+		if zoneOwned.foreign[ep.DNSName] {
+			log.Printf("skipping %s: owned by a different --txt-owner-id in this zone\n", ep.DNSName)
+			continue
+		}
+
+		if !zoneOwned.owned[ep.DNSName] {
+			unmarked, err := batch.filter(ctx, zoneID, func(r cfRecord) bool {
+				return r.Type == ep.Type && r.Name == ep.DNSName
+			})
+			if err != nil {
+				return err
+			}
+			if len(unmarked) > 0 {
+				log.Printf("skipping %s: existing %s records carry no ownership TXT record\n", ep.DNSName, ep.Type)
+				continue
+			}
+			if err := claimOwnership(ctx, batch, zoneID, ep.DNSName, ep.Resource, ep.TTL); err != nil {
+				return err
+			}
+			zoneOwned.owned[ep.DNSName] = true
+		}
+
+		for _, target := range ep.Targets {
+			rec := cfRecord{
+				Type:    ep.Type,
+				Name:    ep.DNSName,
+				Content: target,
+				TTL:     ep.TTL,
+				Proxied: ep.Proxied,
+			}
+			if err := upsertRecord(ctx, batch, zoneID, rec); err != nil {
+				return err
+			}
+		}
+
+		if err := deleteStaleRecords(ctx, batch, zoneID, ep.Type, ep.DNSName, ep.Targets); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
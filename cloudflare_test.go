@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfterSeconds(t *testing.T) {
+	got := parseRetryAfter("5")
+	if got != 5*time.Second {
+		t.Errorf("parseRetryAfter(%q) = %v, want 5s", "5", got)
+	}
+}
+
+func TestParseRetryAfterEmpty(t *testing.T) {
+	if got := parseRetryAfter(""); got != 0 {
+		t.Errorf("parseRetryAfter(\"\") = %v, want 0", got)
+	}
+}
+
+func TestParseRetryAfterHTTPDate(t *testing.T) {
+	future := time.Now().Add(90 * time.Second).UTC().Format(http.TimeFormat)
+	got := parseRetryAfter(future)
+	if got <= 0 || got > 91*time.Second {
+		t.Errorf("parseRetryAfter(%q) = %v, want roughly 90s", future, got)
+	}
+}
+
+func TestRetryBackoffGrowsAndCaps(t *testing.T) {
+	if got := retryBackoff(0); got != 1*time.Second {
+		t.Errorf("retryBackoff(0) = %v, want 1s", got)
+	}
+	if got := retryBackoff(2); got != 4*time.Second {
+		t.Errorf("retryBackoff(2) = %v, want 4s", got)
+	}
+	if got := retryBackoff(10); got != 30*time.Second {
+		t.Errorf("retryBackoff(10) = %v, want the 30s cap", got)
+	}
+}
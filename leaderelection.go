@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+
+	core_v1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typed_core_v1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/client-go/tools/record"
+)
+
+// runWithLeaderElection blocks, running run(ctx) only while this process
+// holds the given Lease, and calling onStoppedLeading (to stop the
+// informers/Cloudflare reconciliation started by run) as soon as leadership
+// is lost or the lease can no longer be renewed.
+func runWithLeaderElection(client kubernetes.Interface, namespace, leaseName string, run func(ctx context.Context), onStoppedLeading func()) {
+	identity, err := os.Hostname()
+	if err != nil {
+		log.Fatalln("failed to determine leader election identity:", err)
+	}
+
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typed_core_v1.EventSinkImpl{Interface: client.CoreV1().Events(namespace)})
+	recorder := broadcaster.NewRecorder(scheme.Scheme, core_v1.EventSource{Component: "cloudflare-sync", Host: identity})
+
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: meta_v1.ObjectMeta{
+			Name:      leaseName,
+			Namespace: namespace,
+		},
+		Client: client.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity:      identity,
+			EventRecorder: recorder,
+		},
+	}
+
+	leaderelection.RunOrDie(context.Background(), leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		ReleaseOnCancel: true,
+		LeaseDuration:   15 * time.Second,
+		RenewDeadline:   10 * time.Second,
+		RetryPeriod:     2 * time.Second,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: run,
+			OnStoppedLeading: func() {
+				log.Println("lost leadership, stopping controller loop")
+				onStoppedLeading()
+			},
+			OnNewLeader: func(newLeader string) {
+				if newLeader != identity {
+					log.Printf("leader elected: %s\n", newLeader)
+				}
+			},
+		},
+	})
+}
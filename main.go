@@ -8,6 +8,8 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	core_v1 "k8s.io/api/core/v1"
@@ -18,28 +20,70 @@ import (
 	"k8s.io/client-go/tools/cache"
 )
 
-var options = struct {
-	CloudflareAPIEmail string
-	CloudflareAPIKey   string
-	CloudflareAPIToken string
-	CloudflareProxy    string
-	CloudflareTTL      string
-	DNSName            string
-	DNSRoots           string
-	UseInternalIP      bool
-	SkipExternalIP     bool
-	NodeSelector       string
-}{
-	CloudflareAPIEmail: os.Getenv("CF_API_EMAIL"),
-	CloudflareAPIKey:   os.Getenv("CF_API_KEY"),
-	CloudflareAPIToken: os.Getenv("CF_API_TOKEN"),
-	CloudflareProxy:    os.Getenv("CF_PROXY"),
-	CloudflareTTL:      os.Getenv("CF_TTL"),
-	DNSName:            os.Getenv("DNS_NAME"),
-	DNSRoots:           os.Getenv("DNS_ROOTS"),
-	UseInternalIP:      os.Getenv("USE_INTERNAL_IP") != "",
-	SkipExternalIP:     os.Getenv("SKIP_EXTERNAL_IP") != "",
-	NodeSelector:       os.Getenv("NODE_SELECTOR"),
+type cliOptions struct {
+	CloudflareAPIEmail   string
+	CloudflareAPIKey     string
+	CloudflareAPIToken   string
+	CloudflareProxy      string
+	CloudflareTTL        string
+	DNSName              string
+	DNSRoots             string
+	UseInternalIP        bool
+	SkipExternalIP       bool
+	NodeSelector         string
+	CloudflareTunnelID   string
+	CloudflareAccountID  string
+	TunnelService        string
+	Sources              string
+	ClusterID            string
+	TXTOwnerID           string
+	LeaderElect          bool
+	LeaderElectNamespace string
+	LeaderElectLeaseName string
+	MetricsAddr          string
+	CloudflareRPS        float64
+	ResyncDebounce       time.Duration
+}
+
+func envFloat(key string, def float64) float64 {
+	v, err := strconv.ParseFloat(os.Getenv(key), 64)
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+func envDuration(key string, def time.Duration) time.Duration {
+	v, err := time.ParseDuration(os.Getenv(key))
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+var options = cliOptions{
+	CloudflareAPIEmail:   os.Getenv("CF_API_EMAIL"),
+	CloudflareAPIKey:     os.Getenv("CF_API_KEY"),
+	CloudflareAPIToken:   os.Getenv("CF_API_TOKEN"),
+	CloudflareProxy:      os.Getenv("CF_PROXY"),
+	CloudflareTTL:        os.Getenv("CF_TTL"),
+	DNSName:              os.Getenv("DNS_NAME"),
+	DNSRoots:             os.Getenv("DNS_ROOTS"),
+	UseInternalIP:        os.Getenv("USE_INTERNAL_IP") != "",
+	SkipExternalIP:       os.Getenv("SKIP_EXTERNAL_IP") != "",
+	NodeSelector:         os.Getenv("NODE_SELECTOR"),
+	CloudflareTunnelID:   os.Getenv("CF_TUNNEL_ID"),
+	CloudflareAccountID:  os.Getenv("CF_ACCOUNT_ID"),
+	TunnelService:        os.Getenv("TUNNEL_SERVICE"),
+	Sources:              os.Getenv("SOURCES"),
+	ClusterID:            os.Getenv("CLUSTER_ID"),
+	TXTOwnerID:           os.Getenv("TXT_OWNER_ID"),
+	LeaderElect:          os.Getenv("LEADER_ELECT") != "",
+	LeaderElectNamespace: os.Getenv("LEADER_ELECT_NAMESPACE"),
+	LeaderElectLeaseName: os.Getenv("LEADER_ELECT_LEASE_NAME"),
+	MetricsAddr:          os.Getenv("METRICS_ADDR"),
+	CloudflareRPS:        envFloat("CF_RPS", 4),
+	ResyncDebounce:       envDuration("RESYNC_DEBOUNCE", 5*time.Second),
 }
 
 func main() {
@@ -53,18 +97,56 @@ func main() {
 	flag.BoolVar(&options.UseInternalIP, "use-internal-ip", options.UseInternalIP, "use internal ips too if external ip's are not available")
 	flag.BoolVar(&options.SkipExternalIP, "skip-external-ip", options.SkipExternalIP, "don't sync external IPs (use in conjunction with --use-internal-ip)")
 	flag.StringVar(&options.NodeSelector, "node-selector", options.NodeSelector, "node selector query")
+	flag.StringVar(&options.CloudflareTunnelID, "cloudflare-tunnel-id", options.CloudflareTunnelID, "the cloudflare tunnel id to manage ingress rules for (enables tunnel mode)")
+	flag.StringVar(&options.CloudflareAccountID, "cloudflare-account-id", options.CloudflareAccountID, "the cloudflare account id that owns the tunnel")
+	flag.StringVar(&options.TunnelService, "tunnel-service", options.TunnelService, "comma-separated dns-name=namespace/service:port mappings routed through the tunnel instead of as plain A records")
+	flag.StringVar(&options.Sources, "sources", options.Sources, "comma-separated list of sources to sync from: node, service, ingress (default node)")
+	flag.StringVar(&options.ClusterID, "cluster-id", options.ClusterID, "identifier for this cluster, recorded in the TXT ownership record's resource field")
+	flag.StringVar(&options.TXTOwnerID, "txt-owner-id", options.TXTOwnerID, "owner id recorded in the TXT ownership record; records without a matching owner are left untouched")
+	flag.BoolVar(&options.LeaderElect, "leader-elect", options.LeaderElect, "run leader election so only one replica reconciles Cloudflare at a time")
+	flag.StringVar(&options.LeaderElectNamespace, "leader-elect-namespace", options.LeaderElectNamespace, "namespace to create the leader election Lease in")
+	flag.StringVar(&options.LeaderElectLeaseName, "leader-elect-lease-name", options.LeaderElectLeaseName, "name of the leader election Lease")
+	flag.StringVar(&options.MetricsAddr, "metrics-addr", options.MetricsAddr, "address to serve /metrics, /healthz and /readyz on (default :9090)")
+	flag.Float64Var(&options.CloudflareRPS, "cloudflare-rps", options.CloudflareRPS, "max Cloudflare API requests per second (Cloudflare allows 1200 per 5 minutes, ~4/s)")
+	flag.DurationVar(&options.ResyncDebounce, "resync-debounce", options.ResyncDebounce, "collapse bursts of node/service/ingress events into one Cloudflare sync after this much quiescence")
 	flag.Parse()
 
+	if options.MetricsAddr == "" {
+		options.MetricsAddr = ":9090"
+	}
+	initCloudflareRateLimiter(options.CloudflareRPS)
+
+	if options.TXTOwnerID == "" {
+		flag.Usage()
+		log.Fatalln("txt owner id is required")
+	}
+
+	if options.CloudflareTunnelID != "" && options.CloudflareAccountID == "" {
+		flag.Usage()
+		log.Fatalln("cloudflare account id is required when cloudflare tunnel id is set")
+	}
+
+	if options.LeaderElect {
+		if options.LeaderElectNamespace == "" {
+			options.LeaderElectNamespace = "default"
+		}
+		if options.LeaderElectLeaseName == "" {
+			options.LeaderElectLeaseName = "cloudflare-sync"
+		}
+	}
+
 	if options.CloudflareAPIToken == "" &&
 		(options.CloudflareAPIEmail == "" || options.CloudflareAPIKey == "") {
 		flag.Usage()
 		log.Fatalln("cloudflare api token or email+key is required")
 	}
 
-	dnsNames := strings.Split(options.DNSName, ",")
-	if len(dnsNames) == 1 && dnsNames[0] == "" {
-		flag.Usage()
-		log.Fatalln("dns name is required")
+	if options.Sources == "" {
+		options.Sources = "node"
+	}
+	sources := map[string]bool{}
+	for _, s := range strings.Split(options.Sources, ",") {
+		sources[strings.TrimSpace(s)] = true
 	}
 
 	dnsRoots := strings.Split(options.DNSRoots, ",")
@@ -73,6 +155,25 @@ func main() {
 		log.Fatalln("dns root is required")
 	}
 
+	// dnsNames feeds both the node-source A/AAAA records and syncTunnel's
+	// ingress/CNAME reconciliation, so it must be populated regardless of
+	// which sources are enabled: a tunnel-only deployment (--sources=service
+	// or --sources=ingress with --cloudflare-tunnel-id set) has no node
+	// source but still needs --dns-name to know what to route through the
+	// tunnel.
+	var dnsNames []string
+	if options.DNSName != "" {
+		dnsNames = strings.Split(options.DNSName, ",")
+	}
+	if sources["node"] && len(dnsNames) == 0 {
+		flag.Usage()
+		log.Fatalln("dns name is required when the node source is enabled")
+	}
+	if options.CloudflareTunnelID != "" && len(dnsNames) == 0 {
+		flag.Usage()
+		log.Fatalln("dns name is required when cloudflare tunnel id is set")
+	}
+
 	cloudflareProxy, err := strconv.ParseBool(options.CloudflareProxy)
 	if err != nil {
 		log.Println("CloudflareProxy config not found or incorrect, defaulting to false")
@@ -98,7 +199,6 @@ func main() {
 	}
 
 	stop := make(chan struct{})
-	defer close(stop)
 
 	nodeSelector := labels.NewSelector()
 	if options.NodeSelector != "" {
@@ -111,68 +211,195 @@ func main() {
 	}
 
 	factory := informers.NewSharedInformerFactory(client, time.Minute)
-	lister := factory.Core().V1().Nodes().Lister()
-	var lastIPs []string
+
+	nodeInformer := factory.Core().V1().Nodes()
+	serviceInformer := factory.Core().V1().Services()
+	ingressInformer := factory.Networking().V1().Ingresses()
+
+	var lastState string
+	firstPass := true
+	// resyncMu serializes resync() so the initial call in run() and any
+	// debounce-triggered call can never run concurrently: the informers
+	// fire Add events for every pre-existing object as soon as their caches
+	// start populating (before factory.Start even returns), arming
+	// debounceTimer independently of the direct resync() call below. Without
+	// this lock, a reconcile() that outlasts options.ResyncDebounce lets
+	// both fire at once -- a data race on lastState/firstPass and two
+	// overlapping Cloudflare reconciliation passes.
+	var resyncMu sync.Mutex
 	resync := func() {
+		resyncMu.Lock()
+		defer resyncMu.Unlock()
+
 		log.Println("resyncing")
-		nodes, err := lister.List(nodeSelector)
-		if err != nil {
-			log.Println("failed to list nodes", err)
-		}
+		resyncTotal.Inc()
+		start := time.Now()
+		defer func() { resyncDuration.Observe(time.Since(start).Seconds()) }()
+
+		var endpoints []endpoint
 
-		var ips []string
-		if !options.SkipExternalIP {
-			for _, node := range nodes {
-				if nodeIsReady(node) {
-					for _, addr := range node.Status.Addresses {
-						if addr.Type == core_v1.NodeExternalIP {
-							ips = append(ips, addr.Address)
+		if sources["node"] {
+			nodes, err := nodeInformer.Lister().List(nodeSelector)
+			if err != nil {
+				log.Println("failed to list nodes", err)
+			}
+
+			var readyNodes int
+			var ips []string
+			if !options.SkipExternalIP {
+				for _, node := range nodes {
+					if nodeIsReady(node) {
+						readyNodes++
+						for _, addr := range node.Status.Addresses {
+							if addr.Type == core_v1.NodeExternalIP {
+								ips = append(ips, addr.Address)
+							}
 						}
 					}
 				}
 			}
-		}
-		if options.UseInternalIP && len(ips) == 0 {
-			for _, node := range nodes {
-				if nodeIsReady(node) {
-					for _, addr := range node.Status.Addresses {
-						if addr.Type == core_v1.NodeInternalIP {
-							ips = append(ips, addr.Address)
+			if options.UseInternalIP && len(ips) == 0 {
+				for _, node := range nodes {
+					if nodeIsReady(node) {
+						for _, addr := range node.Status.Addresses {
+							if addr.Type == core_v1.NodeInternalIP {
+								ips = append(ips, addr.Address)
+							}
 						}
 					}
 				}
 			}
+			sort.Strings(ips)
+			nodesReady.Set(float64(readyNodes))
+			endpoints = append(endpoints, collectNodeEndpoints(dnsNames, ips, cloudflareTTL, cloudflareProxy)...)
+		}
+
+		if sources["service"] {
+			services, err := serviceInformer.Lister().List(labels.Everything())
+			if err != nil {
+				log.Println("failed to list services", err)
+			}
+			endpoints = append(endpoints, collectServiceEndpoints(services, cloudflareTTL, cloudflareProxy)...)
+		}
+
+		if sources["ingress"] {
+			ingresses, err := ingressInformer.Lister().List(labels.Everything())
+			if err != nil {
+				log.Println("failed to list ingresses", err)
+			}
+			endpoints = append(endpoints, collectIngressEndpoints(ingresses, cloudflareTTL, cloudflareProxy)...)
 		}
 
-		sort.Strings(ips)
-		log.Println("ips:", ips)
-		if strings.Join(ips, ",") == strings.Join(lastIPs, ",") {
+		for _, ep := range endpoints {
+			ipsSynced.WithLabelValues(ep.DNSName).Set(float64(len(ep.Targets)))
+		}
+
+		state := endpointsState(endpoints)
+		log.Println("endpoints:", state)
+		// Always reconcile on the first pass, even if it finds zero
+		// endpoints (e.g. --sources=service,ingress with nothing annotated
+		// yet), so /readyz reflects a completed reconciliation instead of
+		// staying unready forever because state matched the zero-value
+		// lastState.
+		if !firstPass && state == lastState {
 			log.Println("no change detected")
 			return
 		}
-		lastIPs = ips
+		firstPass = false
+		lastState = state
 
-		err = sync(context.Background(), ips, dnsNames, dnsRoots, cloudflareTTL, cloudflareProxy)
-		if err != nil {
+		if err := reconcile(context.Background(), endpoints, dnsNames, dnsRoots, cloudflareTTL); err != nil {
 			log.Println("failed to sync", err)
+			return
+		}
+
+		lastSuccessTimestamp.Set(float64(time.Now().Unix()))
+		markReady()
+	}
+
+	// leading gates the debounce timer's callback so a timer armed just
+	// before a leader-election failover can't fire a real Cloudflare
+	// reconciliation on a replica that has since stopped leading.
+	var leading int32
+
+	// debounceResync collapses a burst of Add/Update/Delete events (rolling
+	// upgrades, autoscaler churn) into a single resync once events stop
+	// arriving for options.ResyncDebounce.
+	var debounceMu sync.Mutex
+	var debounceTimer *time.Timer
+	debounceResync := func() {
+		debounceMu.Lock()
+		defer debounceMu.Unlock()
+		if debounceTimer != nil {
+			debounceTimer.Stop()
 		}
+		debounceTimer = time.AfterFunc(options.ResyncDebounce, func() {
+			if atomic.LoadInt32(&leading) == 1 {
+				resync()
+			}
+		})
+	}
+	cancelDebounce := func() {
+		debounceMu.Lock()
+		defer debounceMu.Unlock()
+		if debounceTimer != nil {
+			debounceTimer.Stop()
+		}
+	}
+
+	handlers := cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { debounceResync() },
+		UpdateFunc: func(oldObj, newObj interface{}) { debounceResync() },
+		DeleteFunc: func(obj interface{}) { debounceResync() },
+	}
+
+	if sources["node"] {
+		nodeInformer.Informer().AddEventHandler(handlers)
+	}
+	if sources["service"] {
+		serviceInformer.Informer().AddEventHandler(handlers)
+	}
+	if sources["ingress"] {
+		ingressInformer.Informer().AddEventHandler(handlers)
+	}
+
+	hasSynced := func() bool {
+		if sources["node"] && !nodeInformer.Informer().HasSynced() {
+			return false
+		}
+		if sources["service"] && !serviceInformer.Informer().HasSynced() {
+			return false
+		}
+		if sources["ingress"] && !ingressInformer.Informer().HasSynced() {
+			return false
+		}
+		return true
+	}
+	serveMetrics(options.MetricsAddr, hasSynced)
+
+	run := func(ctx context.Context) {
+		atomic.StoreInt32(&leading, 1)
+		factory.Start(stop)
+		factory.WaitForCacheSync(stop)
+		resync()
+		<-ctx.Done()
+	}
+
+	if options.LeaderElect {
+		runWithLeaderElection(client, options.LeaderElectNamespace, options.LeaderElectLeaseName, run, func() {
+			atomic.StoreInt32(&leading, 0)
+			cancelDebounce()
+			close(stop)
+		})
+		// runWithLeaderElection only returns once this instance has lost
+		// leadership (a standby stays blocked in it, waiting to acquire the
+		// lease); exit so the Cloudflare API isn't
+		// touched by a standby and let Kubernetes restart us to re-enter
+		// the election.
+		os.Exit(1)
 	}
 
-	informer := factory.Core().V1().Nodes().Informer()
-	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
-		AddFunc: func(obj interface{}) {
-			resync()
-		},
-		UpdateFunc: func(oldObj, newObj interface{}) {
-			resync()
-		},
-		DeleteFunc: func(obj interface{}) {
-			resync()
-		},
-	})
-	informer.Run(stop)
-
-	select {}
+	run(context.Background())
 }
 
 func nodeIsReady(node *core_v1.Node) bool {
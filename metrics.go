@@ -0,0 +1,85 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	resyncTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "cfsync_resync_total",
+		Help: "Total number of resync passes run.",
+	})
+
+	resyncDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name: "cfsync_resync_duration_seconds",
+		Help: "Duration of each resync pass.",
+	})
+
+	nodesReady = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "cfsync_nodes_ready",
+		Help: "Number of ready nodes observed in the last resync.",
+	})
+
+	ipsSynced = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "cfsync_ips_synced",
+		Help: "Number of targets currently synced for a dns name.",
+	}, []string{"dns_name"})
+
+	cloudflareAPIRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cfsync_cloudflare_api_requests_total",
+		Help: "Total Cloudflare API requests made, by operation and outcome.",
+	}, []string{"op", "status"})
+
+	cloudflareAPIDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "cfsync_cloudflare_api_duration_seconds",
+		Help: "Duration of Cloudflare API calls, by operation.",
+	}, []string{"op"})
+
+	lastSuccessTimestamp = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "cfsync_last_success_timestamp_seconds",
+		Help: "Unix timestamp of the last successful Cloudflare reconciliation.",
+	})
+)
+
+// ready flips to 1 once the informer caches have synced and at least one
+// Cloudflare reconciliation has completed successfully.
+var ready int32
+
+func markReady() {
+	atomic.StoreInt32(&ready, 1)
+}
+
+func isReady() bool {
+	return atomic.LoadInt32(&ready) == 1
+}
+
+// serveMetrics starts the /metrics, /healthz and /readyz HTTP endpoints in
+// the background. hasSynced reports whether the Kubernetes informer caches
+// have completed their initial sync.
+func serveMetrics(addr string, hasSynced func() bool) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !hasSynced() || !isReady() {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	go func() {
+		log.Println("serving metrics on", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Fatalln("metrics server failed:", err)
+		}
+	}()
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+const ownershipHeritage = "kubernetes-cloudflare-sync"
+
+// txtHeritage builds the TXT record content this controller stamps on every
+// record it manages, so a later run (possibly against a shared zone with
+// records from other tools) can tell which ones are its own.
+func txtHeritage(resource string) string {
+	return fmt.Sprintf("heritage=%s,owner=%s,resource=%s/%s", ownershipHeritage, options.TXTOwnerID, options.ClusterID, resource)
+}
+
+// ownedByUs reports whether a TXT record's content carries our heritage
+// marker for the configured owner id.
+func ownedByUs(content string) bool {
+	if !isHeritage(content) {
+		return false
+	}
+	for _, field := range strings.Split(strings.Trim(content, `"`), ",") {
+		if field == "owner="+options.TXTOwnerID {
+			return true
+		}
+	}
+	return false
+}
+
+// isHeritage reports whether a TXT record's content carries our heritage
+// marker at all, regardless of which owner it names.
+func isHeritage(content string) bool {
+	return strings.Contains(content, "heritage="+ownershipHeritage)
+}
+
+// zoneOwnership is the result of listing a zone's TXT heritage records: the
+// names we already own, and the names owned by some other --txt-owner-id
+// that we must never touch.
+type zoneOwnership struct {
+	owned   map[string]bool
+	foreign map[string]bool
+}
+
+// listOwnership partitions the record names in a zone that carry our TXT
+// heritage marker into ones we own and ones owned by a different owner id.
+func listOwnership(ctx context.Context, b *recordBatch, zoneID string) (zoneOwnership, error) {
+	txts, err := b.filter(ctx, zoneID, func(r cfRecord) bool { return r.Type == "TXT" })
+	if err != nil {
+		return zoneOwnership{}, err
+	}
+
+	result := zoneOwnership{owned: map[string]bool{}, foreign: map[string]bool{}}
+	for _, t := range txts {
+		if !isHeritage(t.Content) {
+			continue
+		}
+		if ownedByUs(t.Content) {
+			result.owned[t.Name] = true
+		} else {
+			result.foreign[t.Name] = true
+		}
+	}
+	return result, nil
+}
+
+// zoneOwnershipFor returns the cached zoneOwnership for zoneID, populating
+// the cache with a fresh listOwnership lookup on first use. Callers that
+// touch records across more than one zone pass the same cache map so each
+// zone's TXT records are only listed once per reconciliation pass.
+func zoneOwnershipFor(ctx context.Context, b *recordBatch, cache map[string]zoneOwnership, zoneID string) (zoneOwnership, error) {
+	if zoneOwned, ok := cache[zoneID]; ok {
+		return zoneOwned, nil
+	}
+	zoneOwned, err := listOwnership(ctx, b, zoneID)
+	if err != nil {
+		return zoneOwnership{}, err
+	}
+	cache[zoneID] = zoneOwned
+	return zoneOwned, nil
+}
+
+// claimOwnership writes (or refreshes) the TXT heritage record for name,
+// marking it as owned by this controller for resource.
+func claimOwnership(ctx context.Context, b *recordBatch, zoneID, name, resource string, ttl int) error {
+	rec := cfRecord{
+		Type:    "TXT",
+		Name:    name,
+		Content: txtHeritage(resource),
+		TTL:     ttl,
+	}
+	return upsertRecord(ctx, b, zoneID, rec)
+}
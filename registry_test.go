@@ -0,0 +1,40 @@
+package main
+
+import "testing"
+
+func TestTxtHeritageAndOwnedByUs(t *testing.T) {
+	prevOwner, prevCluster := options.TXTOwnerID, options.ClusterID
+	options.TXTOwnerID = "cluster-a"
+	options.ClusterID = "prod"
+	defer func() { options.TXTOwnerID, options.ClusterID = prevOwner, prevCluster }()
+
+	content := txtHeritage("node/*")
+
+	if !ownedByUs(content) {
+		t.Fatalf("ownedByUs(%q) = false, want true for our own heritage record", content)
+	}
+	if !isHeritage(content) {
+		t.Fatalf("isHeritage(%q) = false, want true", content)
+	}
+}
+
+func TestOwnedByUsRejectsForeignOwner(t *testing.T) {
+	prevOwner := options.TXTOwnerID
+	options.TXTOwnerID = "cluster-a"
+	defer func() { options.TXTOwnerID = prevOwner }()
+
+	foreign := "heritage=kubernetes-cloudflare-sync,owner=cluster-b,resource=prod/node/*"
+
+	if ownedByUs(foreign) {
+		t.Fatalf("ownedByUs(%q) = true, want false for a different owner", foreign)
+	}
+	if !isHeritage(foreign) {
+		t.Fatalf("isHeritage(%q) = false, want true: it still carries our heritage marker, just a foreign owner", foreign)
+	}
+}
+
+func TestIsHeritageRejectsUnrelatedRecords(t *testing.T) {
+	if isHeritage("v=spf1 include:_spf.example.com ~all") {
+		t.Fatal("isHeritage() = true for an unrelated TXT record, want false")
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	core_v1 "k8s.io/api/core/v1"
+	networking_v1 "k8s.io/api/networking/v1"
+)
+
+const (
+	annotationHostname = "cloudflare-sync/hostname"
+	annotationProxied  = "cloudflare-sync/proxied"
+	annotationTTL      = "cloudflare-sync/ttl"
+)
+
+// endpoint is a single DNS record to reconcile against Cloudflare: the fqdn
+// plus the set of A/AAAA/CNAME targets it should resolve to. Resource
+// identifies the Kubernetes object that produced it (e.g. "node/*" or
+// "service/default/web"), and is recorded in the TXT ownership record so a
+// later run can tell this endpoint apart from unrelated records in the zone.
+type endpoint struct {
+	DNSName  string
+	Targets  []string
+	Type     string // "A", "AAAA" or "CNAME"
+	TTL      int
+	Proxied  bool
+	Resource string
+}
+
+// collectNodeEndpoints builds the A/AAAA endpoints for every configured
+// --dns-name, pointing at the given node ips, split by IP family.
+func collectNodeEndpoints(dnsNames []string, ips []string, ttl int, proxied bool) []endpoint {
+	var v4, v6 []string
+	for _, ip := range ips {
+		parsed := net.ParseIP(ip)
+		switch {
+		case parsed == nil:
+			continue
+		case parsed.To4() != nil:
+			v4 = append(v4, ip)
+		default:
+			v6 = append(v6, ip)
+		}
+	}
+
+	var endpoints []endpoint
+	for _, name := range dnsNames {
+		if len(v4) > 0 {
+			endpoints = append(endpoints, endpoint{DNSName: name, Targets: v4, Type: "A", TTL: ttl, Proxied: proxied, Resource: "node/*"})
+		}
+		if len(v6) > 0 {
+			endpoints = append(endpoints, endpoint{DNSName: name, Targets: v6, Type: "AAAA", TTL: ttl, Proxied: proxied, Resource: "node/*"})
+		}
+	}
+	return endpoints
+}
+
+// collectServiceEndpoints builds an endpoint for every LoadBalancer Service
+// annotated with cloudflare-sync/hostname, using its load-balancer ingress
+// ips/hostnames as targets.
+func collectServiceEndpoints(services []*core_v1.Service, defaultTTL int, defaultProxied bool) []endpoint {
+	var endpoints []endpoint
+	for _, svc := range services {
+		if svc.Spec.Type != core_v1.ServiceTypeLoadBalancer {
+			continue
+		}
+		resource := fmt.Sprintf("service/%s/%s", svc.Namespace, svc.Name)
+		if eps, ok := endpointFromAnnotations(svc.Annotations, svc.Status.LoadBalancer.Ingress, resource, defaultTTL, defaultProxied); ok {
+			endpoints = append(endpoints, eps...)
+		}
+	}
+	return endpoints
+}
+
+// collectIngressEndpoints builds an endpoint for every Ingress annotated
+// with cloudflare-sync/hostname, using its load-balancer ingress
+// ips/hostnames as targets.
+func collectIngressEndpoints(ingresses []*networking_v1.Ingress, defaultTTL int, defaultProxied bool) []endpoint {
+	var endpoints []endpoint
+	for _, ing := range ingresses {
+		resource := fmt.Sprintf("ingress/%s/%s", ing.Namespace, ing.Name)
+		if eps, ok := endpointFromAnnotations(ing.Annotations, coreLBIngress(ing.Status.LoadBalancer.Ingress), resource, defaultTTL, defaultProxied); ok {
+			endpoints = append(endpoints, eps...)
+		}
+	}
+	return endpoints
+}
+
+// coreLBIngress adapts networking/v1's IngressLoadBalancerIngress slice (the
+// type Ingress.Status uses) to core/v1's LoadBalancerIngress (the type
+// Service.Status uses and endpointFromAnnotations accepts), so both sources
+// can share one extraction path.
+func coreLBIngress(in []networking_v1.IngressLoadBalancerIngress) []core_v1.LoadBalancerIngress {
+	out := make([]core_v1.LoadBalancerIngress, 0, len(in))
+	for _, lb := range in {
+		out = append(out, core_v1.LoadBalancerIngress{IP: lb.IP, Hostname: lb.Hostname})
+	}
+	return out
+}
+
+// endpointFromAnnotations turns the cloudflare-sync/* annotations and
+// load-balancer status of a Service or Ingress into its endpoints, reporting
+// ok=false if the object isn't annotated with a hostname or has no
+// load-balancer targets yet. A dual-stack load-balancer (v4 and v6 ips, or
+// ips and a hostname) produces one endpoint per record type, the same way
+// collectNodeEndpoints splits v4/v6 node ips, rather than folding mismatched
+// targets into a single record.
+func endpointFromAnnotations(annotations map[string]string, lbIngress []core_v1.LoadBalancerIngress, resource string, defaultTTL int, defaultProxied bool) ([]endpoint, bool) {
+	hostname := annotations[annotationHostname]
+	if hostname == "" {
+		return nil, false
+	}
+
+	ttl := defaultTTL
+	if v, err := strconv.Atoi(annotations[annotationTTL]); err == nil {
+		ttl = v
+	}
+
+	proxied := defaultProxied
+	if v, err := strconv.ParseBool(annotations[annotationProxied]); err == nil {
+		proxied = v
+	}
+
+	var v4, v6, hostnames []string
+	for _, lb := range lbIngress {
+		switch {
+		case lb.IP != "":
+			parsed := net.ParseIP(lb.IP)
+			switch {
+			case parsed == nil:
+				continue
+			case parsed.To4() != nil:
+				v4 = append(v4, lb.IP)
+			default:
+				v6 = append(v6, lb.IP)
+			}
+		case lb.Hostname != "":
+			hostnames = append(hostnames, lb.Hostname)
+		}
+	}
+	if len(v4) == 0 && len(v6) == 0 && len(hostnames) == 0 {
+		return nil, false
+	}
+
+	base := endpoint{DNSName: hostname, TTL: ttl, Proxied: proxied, Resource: resource}
+	var endpoints []endpoint
+	if len(v4) > 0 {
+		ep := base
+		ep.Targets, ep.Type = v4, "A"
+		endpoints = append(endpoints, ep)
+	}
+	if len(v6) > 0 {
+		ep := base
+		ep.Targets, ep.Type = v6, "AAAA"
+		endpoints = append(endpoints, ep)
+	}
+	if len(hostnames) > 0 {
+		ep := base
+		ep.Targets, ep.Type = hostnames, "CNAME"
+		endpoints = append(endpoints, ep)
+	}
+	return endpoints, true
+}
+
+// endpointsState returns a deterministic string summarizing a set of
+// endpoints, used to detect whether anything actually changed between
+// resyncs.
+func endpointsState(endpoints []endpoint) string {
+	lines := make([]string, 0, len(endpoints))
+	for _, ep := range endpoints {
+		targets := append([]string(nil), ep.Targets...)
+		sort.Strings(targets)
+		lines = append(lines, fmt.Sprintf("%s|%s|%d|%t|%s", ep.DNSName, ep.Type, ep.TTL, ep.Proxied, strings.Join(targets, ",")))
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, ";")
+}
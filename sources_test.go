@@ -0,0 +1,103 @@
+package main
+
+import (
+	"testing"
+
+	core_v1 "k8s.io/api/core/v1"
+)
+
+func TestCollectNodeEndpointsSplitsV4AndV6(t *testing.T) {
+	endpoints := collectNodeEndpoints([]string{"nodes.example.com"}, []string{"203.0.113.10", "2001:db8::1"}, 120, false)
+
+	var gotA, gotAAAA *endpoint
+	for i := range endpoints {
+		switch endpoints[i].Type {
+		case "A":
+			gotA = &endpoints[i]
+		case "AAAA":
+			gotAAAA = &endpoints[i]
+		}
+	}
+
+	if gotA == nil || len(gotA.Targets) != 1 || gotA.Targets[0] != "203.0.113.10" {
+		t.Errorf("A endpoint = %+v, want one target 203.0.113.10", gotA)
+	}
+	if gotAAAA == nil || len(gotAAAA.Targets) != 1 || gotAAAA.Targets[0] != "2001:db8::1" {
+		t.Errorf("AAAA endpoint = %+v, want one target 2001:db8::1", gotAAAA)
+	}
+}
+
+func TestEndpointFromAnnotationsNoHostname(t *testing.T) {
+	_, ok := endpointFromAnnotations(nil, nil, "service/default/web", 120, false)
+	if ok {
+		t.Fatal("endpointFromAnnotations() with no hostname annotation returned ok=true")
+	}
+}
+
+func TestEndpointFromAnnotationsIP(t *testing.T) {
+	annotations := map[string]string{
+		annotationHostname: "web.example.com",
+		annotationTTL:      "60",
+		annotationProxied:  "true",
+	}
+	lb := []core_v1.LoadBalancerIngress{{IP: "203.0.113.10"}}
+
+	eps, ok := endpointFromAnnotations(annotations, lb, "service/default/web", 120, false)
+	if !ok {
+		t.Fatal("endpointFromAnnotations() = ok=false, want ok=true")
+	}
+	if len(eps) != 1 {
+		t.Fatalf("endpointFromAnnotations() = %+v, want exactly one endpoint", eps)
+	}
+	ep := eps[0]
+	if ep.Type != "A" || ep.TTL != 60 || !ep.Proxied || ep.DNSName != "web.example.com" {
+		t.Errorf("endpointFromAnnotations() = %+v, want A record with ttl=60 proxied=true", ep)
+	}
+}
+
+func TestEndpointFromAnnotationsHostname(t *testing.T) {
+	annotations := map[string]string{annotationHostname: "web.example.com"}
+	lb := []core_v1.LoadBalancerIngress{{Hostname: "lb.cloudprovider.example"}}
+
+	eps, ok := endpointFromAnnotations(annotations, lb, "service/default/web", 120, false)
+	if !ok {
+		t.Fatal("endpointFromAnnotations() = ok=false, want ok=true")
+	}
+	if len(eps) != 1 {
+		t.Fatalf("endpointFromAnnotations() = %+v, want exactly one endpoint", eps)
+	}
+	ep := eps[0]
+	if ep.Type != "CNAME" || len(ep.Targets) != 1 || ep.Targets[0] != "lb.cloudprovider.example" {
+		t.Errorf("endpointFromAnnotations() = %+v, want a CNAME to the lb hostname", ep)
+	}
+}
+
+func TestEndpointFromAnnotationsDualStackSplitsByType(t *testing.T) {
+	annotations := map[string]string{annotationHostname: "web.example.com"}
+	lb := []core_v1.LoadBalancerIngress{
+		{IP: "203.0.113.10"},
+		{IP: "2001:db8::1"},
+	}
+
+	eps, ok := endpointFromAnnotations(annotations, lb, "service/default/web", 120, false)
+	if !ok {
+		t.Fatal("endpointFromAnnotations() = ok=false, want ok=true")
+	}
+	if len(eps) != 2 {
+		t.Fatalf("endpointFromAnnotations() = %+v, want one A and one AAAA endpoint", eps)
+	}
+	for _, ep := range eps {
+		switch ep.Type {
+		case "A":
+			if len(ep.Targets) != 1 || ep.Targets[0] != "203.0.113.10" {
+				t.Errorf("A endpoint = %+v, want only the v4 target", ep)
+			}
+		case "AAAA":
+			if len(ep.Targets) != 1 || ep.Targets[0] != "2001:db8::1" {
+				t.Errorf("AAAA endpoint = %+v, want only the v6 target", ep)
+			}
+		default:
+			t.Errorf("unexpected endpoint type %q", ep.Type)
+		}
+	}
+}
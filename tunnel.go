@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// cfTunnelIngress is a single entry of a Cloudflare Tunnel's
+// config.ingress list.
+type cfTunnelIngress struct {
+	Hostname      string                 `json:"hostname,omitempty"`
+	Service       string                 `json:"service"`
+	OriginRequest map[string]interface{} `json:"originRequest,omitempty"`
+}
+
+type cfTunnelConfig struct {
+	Ingress []cfTunnelIngress `json:"ingress"`
+}
+
+type cfTunnelConfiguration struct {
+	Config cfTunnelConfig `json:"config"`
+}
+
+// tunnelServiceFor returns the namespace/service:port mapping configured via
+// --tunnel-service for the given dns name, or "" if none is configured.
+func (o cliOptions) tunnelServiceFor(name string) string {
+	return tunnelServices(o.TunnelService)[name]
+}
+
+// tunnelServices parses the --tunnel-service flag (a comma-separated list of
+// dns-name=namespace/service:port entries) into a lookup map.
+func tunnelServices(raw string) map[string]string {
+	services := map[string]string{}
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		services[parts[0]] = parts[1]
+	}
+	return services
+}
+
+// syncTunnel reconciles the Cloudflare Tunnel ingress configuration so that
+// each dnsName with a configured tunnel-service routes to that service, and
+// upserts the CNAME record pointing dnsName at the tunnel. ownership is the
+// zoneID -> zoneOwnership cache shared with reconcile's main endpoint loop;
+// a name already carrying another controller's heritage TXT is skipped
+// rather than taken over.
+func syncTunnel(ctx context.Context, batch *recordBatch, ownership map[string]zoneOwnership, dnsNames []string, dnsRoots []string, ttl int) error {
+	services := tunnelServices(options.TunnelService)
+
+	var current cfTunnelConfiguration
+	getPath := fmt.Sprintf("/accounts/%s/cfd_tunnel/%s/configurations", options.CloudflareAccountID, options.CloudflareTunnelID)
+	if err := cfRequest(ctx, "get_tunnel_configuration", http.MethodGet, getPath, nil, &current); err != nil {
+		return err
+	}
+
+	managed := managedTunnelNames(dnsNames, services)
+	ingress := mergeTunnelIngress(current.Config.Ingress, dnsNames, services, managed)
+
+	body := cfTunnelConfiguration{Config: cfTunnelConfig{Ingress: ingress}}
+	putPath := fmt.Sprintf("/accounts/%s/cfd_tunnel/%s/configurations", options.CloudflareAccountID, options.CloudflareTunnelID)
+	if err := cfRequest(ctx, "update_tunnel_configuration", http.MethodPatch, putPath, body, nil); err != nil {
+		return err
+	}
+
+	cname := options.CloudflareTunnelID + ".cfargotunnel.com"
+	for name := range managed {
+		root, err := findRoot(name, dnsRoots)
+		if err != nil {
+			return err
+		}
+		zoneID, err := zoneIDForRoot(ctx, root)
+		if err != nil {
+			return err
+		}
+
+		zoneOwned, err := zoneOwnershipFor(ctx, batch, ownership, zoneID)
+		if err != nil {
+			return err
+		}
+		if zoneOwned.foreign[name] {
+			log.Printf("skipping tunnel hostname %s: owned by a different --txt-owner-id in this zone\n", name)
+			continue
+		}
+
+		if err := claimOwnership(ctx, batch, zoneID, name, "tunnel/"+options.CloudflareTunnelID, ttl); err != nil {
+			return err
+		}
+		zoneOwned.owned[name] = true
+		rec := cfRecord{
+			Type:    "CNAME",
+			Name:    name,
+			Content: cname,
+			TTL:     ttl,
+			Proxied: true,
+		}
+		if err := upsertRecord(ctx, batch, zoneID, rec); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// managedTunnelNames returns the subset of dnsNames that have a
+// --tunnel-service mapping, i.e. the hostnames syncTunnel owns an ingress
+// rule for.
+func managedTunnelNames(dnsNames []string, services map[string]string) map[string]bool {
+	managed := make(map[string]bool, len(dnsNames))
+	for _, name := range dnsNames {
+		if services[name] != "" {
+			managed[name] = true
+		}
+	}
+	return managed
+}
+
+// mergeTunnelIngress combines the tunnel's existing ingress rules with the
+// ones we manage: preserved user-managed rules (non-empty hostname, not one
+// of ours), then one rule per managed dnsName, then a single catch-all.
+// The previous run's own catch-all (the one entry with an empty hostname) is
+// always dropped rather than preserved, since the trailing append below is
+// the only rule allowed to have an empty hostname.
+func mergeTunnelIngress(current []cfTunnelIngress, dnsNames []string, services map[string]string, managed map[string]bool) []cfTunnelIngress {
+	var ingress []cfTunnelIngress
+	for _, entry := range current {
+		if entry.Hostname != "" && !managed[entry.Hostname] {
+			ingress = append(ingress, entry)
+		}
+	}
+	for _, name := range dnsNames {
+		service := services[name]
+		if service == "" {
+			continue
+		}
+		ingress = append(ingress, cfTunnelIngress{
+			Hostname: name,
+			Service:  tunnelUpstream(service),
+		})
+	}
+	ingress = append(ingress, cfTunnelIngress{Service: "http_status:404"})
+	return ingress
+}
+
+// tunnelUpstream turns a namespace/service:port mapping into the in-cluster
+// URL cloudflared should proxy to.
+func tunnelUpstream(namespaceService string) string {
+	parts := strings.SplitN(namespaceService, "/", 2)
+	if len(parts) != 2 {
+		return "http://" + namespaceService
+	}
+	service, port := parts[1], ""
+	if i := strings.LastIndex(service, ":"); i >= 0 {
+		service, port = service[:i], service[i:]
+	}
+	return fmt.Sprintf("http://%s.%s.svc.cluster.local%s", service, parts[0], port)
+}
@@ -0,0 +1,64 @@
+package main
+
+import "testing"
+
+func TestTunnelServices(t *testing.T) {
+	got := tunnelServices(" a.example.com=default/web:80 , b.example.com=ops/api:8080,bad-entry, ")
+	want := map[string]string{
+		"a.example.com": "default/web:80",
+		"b.example.com": "ops/api:8080",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("tunnelServices() = %v, want %v", got, want)
+	}
+	for name, service := range want {
+		if got[name] != service {
+			t.Errorf("tunnelServices()[%q] = %q, want %q", name, got[name], service)
+		}
+	}
+}
+
+func TestMergeTunnelIngressDropsStaleCatchAll(t *testing.T) {
+	dnsNames := []string{"a.example.com"}
+	services := map[string]string{"a.example.com": "default/web:80"}
+	managed := managedTunnelNames(dnsNames, services)
+
+	// current already has a catch-all from a previous run, which must not
+	// survive ahead of the hostname rule.
+	current := []cfTunnelIngress{
+		{Service: "http_status:404"},
+	}
+
+	ingress := mergeTunnelIngress(current, dnsNames, services, managed)
+
+	if len(ingress) != 2 {
+		t.Fatalf("len(ingress) = %d, want 2: %+v", len(ingress), ingress)
+	}
+	if ingress[0].Hostname != "a.example.com" {
+		t.Errorf("ingress[0].Hostname = %q, want the managed hostname first", ingress[0].Hostname)
+	}
+	last := ingress[len(ingress)-1]
+	if last.Hostname != "" || last.Service != "http_status:404" {
+		t.Errorf("last entry = %+v, want the single catch-all", last)
+	}
+}
+
+func TestMergeTunnelIngressKeepsUserManagedEntries(t *testing.T) {
+	dnsNames := []string{"a.example.com"}
+	services := map[string]string{"a.example.com": "default/web:80"}
+	managed := managedTunnelNames(dnsNames, services)
+
+	current := []cfTunnelIngress{
+		{Hostname: "other.example.com", Service: "http://other"},
+		{Service: "http_status:404"},
+	}
+
+	ingress := mergeTunnelIngress(current, dnsNames, services, managed)
+
+	if len(ingress) != 3 {
+		t.Fatalf("len(ingress) = %d, want 3: %+v", len(ingress), ingress)
+	}
+	if ingress[0].Hostname != "other.example.com" {
+		t.Errorf("ingress[0] = %+v, want the preserved user-managed entry first", ingress[0])
+	}
+}